@@ -37,6 +37,14 @@ func (sig BdnSignature) Verify(suite pairing.Suite, msg []byte, pubkeys []kyber.
 // VerifyWithPolicy checks that the signature is correct and that the number of signers
 // matches the policy.
 func (sig BdnSignature) VerifyWithPolicy(suite pairing.Suite, msg []byte, pubkeys []kyber.Point, policy sign.Policy) error {
+	return sig.VerifyWithAggregateKey(suite, msg, pubkeys, policy, bdn.AggregatePublicKeys)
+}
+
+// VerifyWithAggregateKey checks that the signature is correct and that the
+// number of signers matches the policy, using the aggregate public key of the
+// signers given by the aggregate function.
+func (sig BdnSignature) VerifyWithAggregateKey(suite pairing.Suite, msg []byte, pubkeys []kyber.Point,
+	policy sign.Policy, aggregate protocol.AggregateKeyFn) error {
 	lenCom := suite.G1().PointLen()
 	if len(sig) < lenCom {
 		return errors.New("invalid signature length")
@@ -50,7 +58,7 @@ func (sig BdnSignature) VerifyWithPolicy(suite pairing.Suite, msg []byte, pubkey
 		return err
 	}
 
-	aggPub, err := bdn.AggregatePublicKeys(suite, mask)
+	aggPub, err := aggregate(suite, mask)
 	if err != nil {
 		return err
 	}
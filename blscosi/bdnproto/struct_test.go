@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/pairing/bn256"
 	"go.dedis.ch/kyber/v3/sign"
 	"go.dedis.ch/kyber/v3/sign/bdn"
@@ -47,3 +48,38 @@ func TestBdnSignature_Verify(t *testing.T) {
 	wrongMsg := []byte("cba")
 	require.Error(t, sig.VerifyWithPolicy(suite, wrongMsg, pubkeys, policy))
 }
+
+func TestBdnSignature_VerifyWithAggregateKey(t *testing.T) {
+	msg := []byte("abc")
+	suite := bn256.NewSuite()
+	sk, pk := bdn.NewKeyPair(suite, random.New())
+	pubkeys := []kyber.Point{pk}
+
+	mask, err := sign.NewMask(suite, pubkeys, nil)
+	require.NoError(t, err)
+	mask.SetBit(0, true)
+
+	s, err := bdn.Sign(suite, sk, msg)
+	require.NoError(t, err)
+	asig, err := bdn.AggregateSignatures(suite, [][]byte{s}, mask)
+	require.NoError(t, err)
+	buf, err := asig.MarshalBinary()
+	require.NoError(t, err)
+	sig := BdnSignature(append(buf, mask.Mask()...))
+	policy := sign.NewThresholdPolicy(1)
+
+	// the given aggregate key is used instead of the one of the mask
+	calls := 0
+	aggregate := func(suite pairing.Suite, mask *sign.Mask) (kyber.Point, error) {
+		calls++
+		return bdn.AggregatePublicKeys(suite, mask)
+	}
+	require.NoError(t, sig.VerifyWithAggregateKey(suite, msg, pubkeys, policy, aggregate))
+	require.Equal(t, 1, calls)
+
+	_, other := bdn.NewKeyPair(suite, random.New())
+	wrongKey := func(pairing.Suite, *sign.Mask) (kyber.Point, error) {
+		return other, nil
+	}
+	require.Error(t, sig.VerifyWithAggregateKey(suite, msg, pubkeys, policy, wrongKey))
+}
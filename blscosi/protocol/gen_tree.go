@@ -3,6 +3,7 @@ package protocol
 import (
 	"errors"
 	"fmt"
+	"sort"
 
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/network"
@@ -16,6 +17,69 @@ func NewBlsProtocolTree(tree *onet.Tree, nSubTrees int) (BlsProtocolTree, error)
 	return genTrees(tree, nSubTrees)
 }
 
+// NewBlsProtocolTreeFromAssignment creates the subtrees of the BLS CoSi
+// protocol from an explicit assignment of the leaves to the subleaders, given
+// as roster indexes. The subtrees are ordered by subleader index.
+func NewBlsProtocolTreeFromAssignment(tree *onet.Tree, assignment map[int][]int) (BlsProtocolTree, error) {
+	if tree == nil || tree.Roster == nil {
+		return nil, errors.New("the roster is nil")
+	}
+	nNodes := len(tree.Roster.List)
+	root := tree.Root.RosterIndex
+
+	if len(assignment) == 0 && nNodes > 1 {
+		return nil, errors.New("the assignment needs at least one subleader")
+	}
+
+	seen := make([]bool, nNodes)
+	seen[root] = true
+	assign := func(i int) error {
+		if i < 0 || i >= nNodes {
+			return fmt.Errorf("index %d is out of the roster", i)
+		}
+		if seen[i] {
+			if i == root {
+				return fmt.Errorf("index %d is the root", i)
+			}
+			return fmt.Errorf("index %d is assigned more than once", i)
+		}
+		seen[i] = true
+		return nil
+	}
+
+	subleaders := make([]int, 0, len(assignment))
+	for sl, leaves := range assignment {
+		if err := assign(sl); err != nil {
+			return nil, err
+		}
+		for _, l := range leaves {
+			if err := assign(l); err != nil {
+				return nil, err
+			}
+		}
+		subleaders = append(subleaders, sl)
+	}
+	for i, ok := range seen {
+		if !ok {
+			return nil, fmt.Errorf("index %d is not assigned", i)
+		}
+	}
+	sort.Ints(subleaders)
+
+	trees := make([]*onet.Tree, len(subleaders))
+	for i, sl := range subleaders {
+		nodes := append([]int{root, sl}, assignment[sl]...)
+
+		var err error
+		trees[i], err = genSubtree(tree.Roster, nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trees, nil
+}
+
 // GetLeaves returns the server identities of the leaves
 func (pt BlsProtocolTree) GetLeaves() []*network.ServerIdentity {
 	si := []*network.ServerIdentity{}
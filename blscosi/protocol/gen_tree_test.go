@@ -216,6 +216,51 @@ func TestGenTreesUsesWholeRoster(t *testing.T) {
 	}
 }
 
+// tests that the subtrees follow an explicit assignment of the leaves
+func TestNewBlsProtocolTreeFromAssignment(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(7, false)
+
+	trees, err := NewBlsProtocolTreeFromAssignment(tree, map[int][]int{6: {1, 2}, 3: {4, 5}})
+	if err != nil {
+		t.Fatal("Error in tree generation:", err)
+	}
+	if len(trees) != 2 {
+		t.Fatal("there should be 2 subtrees but there are", len(trees))
+	}
+	expected := [][]int{{3, 4, 5}, {6, 1, 2}}
+	for i, tree := range trees {
+		subleader := tree.Root.Children[0]
+		if tree.Root.RosterIndex != 0 || subleader.RosterIndex != expected[i][0] {
+			t.Fatal("wrong root or subleader in subtree", i)
+		}
+		for j, leaf := range subleader.Children {
+			if leaf.RosterIndex != expected[i][j+1] {
+				t.Fatal("wrong leaf in subtree", i)
+			}
+		}
+	}
+
+	invalid := []map[int][]int{
+		{},
+		{1: {2, 3, 4, 5}},              // missing node
+		{1: {2, 3}, 4: {5, 6, 2}},      // duplicate leaf
+		{1: {2, 3}, 4: {5, 6, 0}},      // root as a leaf
+		{0: {1, 2, 3}, 4: {5, 6}},      // root as a subleader
+		{1: {2, 3}, 4: {5, 6}, 7: {}},  // out of the roster
+		{1: {2, 3, 1}, 4: {5, 6}},      // subleader as its own leaf
+		{1: {2, 3}, 4: {5, 6}, 2: {}},  // leaf as a subleader
+		{1: {2, 3}, 4: {5, 6}, -1: {}}, // negative index
+	}
+	for i, assignment := range invalid {
+		_, err := NewBlsProtocolTreeFromAssignment(tree, assignment)
+		if err == nil {
+			t.Fatal("assignment", i, "should be rejected")
+		}
+	}
+}
+
 // tests that the subtree generator puts the correct subleader in place
 func TestGenSubtreePutsCorrectSubleader(t *testing.T) {
 	nodes := []int{2, 5, 20}
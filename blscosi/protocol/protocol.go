@@ -34,6 +34,18 @@ func init() {
 const defaultTimeout = 10 * time.Second
 const defaultSubleaderFailures = 2
 
+// ErrorTimeout is returned when the responses needed to reach the threshold
+// are not received before the timeout.
+var ErrorTimeout = xerrors.New("timeout while collecting the responses")
+
+// ErrorThresholdNotReached is returned when the responses show that the
+// threshold can't be reached because too many nodes refused to sign.
+var ErrorThresholdNotReached = xerrors.New("threshold not reached")
+
+// ErrorRootRefused is returned when the verification fails on the root and
+// AllowRootRefusal is not set.
+var ErrorRootRefused = xerrors.New("verification failed on root node")
+
 // VerificationFn is called on every node. Where msg is the message that is
 // co-signed and the data is additional data for verification.
 type VerificationFn func(msg, data []byte) bool
@@ -63,16 +75,37 @@ type BlsCosi struct {
 	// for waiting for responses for sub protocols.
 	Timeout           time.Duration
 	SubleaderFailures int
-	Threshold         int
-	FinalSignature    chan []byte // final signature that is sent back to client
+	// Threshold is the number of signers needed for the signature, or their
+	// total weight when Weights is set.
+	Threshold int
+	// Weights, when set, gives the weight of each node of the roster, in the
+	// same order, and the Threshold is then the minimum total weight of the
+	// signers instead of their number.
+	Weights []int
+	// AllowRootRefusal lets the protocol go on without the signature of the
+	// root when its verification fails, instead of stopping right away. The
+	// root is then counted as a failure.
+	AllowRootRefusal bool
+	// MaxConcurrentSubtrees limits the number of sub protocols running at
+	// the same time, the others being started when a running one is done.
+	// Zero means that every sub protocol is started at once. A low value
+	// reduces the resources used by the root but serializes the subtrees,
+	// so the Timeout must be increased accordingly.
+	MaxConcurrentSubtrees int
+	FinalSignature        chan []byte // final signature that is sent back to client
 
 	stoppedOnce      sync.Once
+	stopped          chan struct{}
+	finalLock        sync.Mutex
+	errLock          sync.Mutex
+	err              error
 	subProtocolsLock sync.Mutex
 	subProtocols     []*SubBlsCosi
 	subProtocolName  string
 	verificationFn   VerificationFn
 	suite            *pairing.SuiteBn256
 	subTrees         BlsProtocolTree
+	rootRefused      bool
 }
 
 // CreateProtocolFunction is a function type which creates a new protocol
@@ -98,6 +131,41 @@ func DefaultThreshold(n int) int {
 	return n - DefaultFaultyThreshold(n)
 }
 
+// WeightPolicy is a signature policy fulfilled when the total weight of the
+// signers reaches a threshold.
+type WeightPolicy struct {
+	weights   []int
+	threshold int
+}
+
+// NewWeightPolicy returns a policy that requires the weights of the signers,
+// given in the order of the public keys, to add up to at least the threshold.
+func NewWeightPolicy(weights []int, threshold int) *WeightPolicy {
+	return &WeightPolicy{weights: weights, threshold: threshold}
+}
+
+// Check returns true when the signers of the mask reach the threshold. The
+// mask must be a *sign.Mask, any other one is refused.
+func (p *WeightPolicy) Check(m sign.ParticipationMask) bool {
+	mask, ok := m.(*sign.Mask)
+	if !ok {
+		log.Errorf("weight policy used with an unsupported mask: %T", m)
+		return false
+	}
+	return maskWeight(mask.Mask(), p.weights) >= p.threshold
+}
+
+// maskWeight returns the total weight of the participants of the mask.
+func maskWeight(mask []byte, weights []int) int {
+	total := 0
+	for i, w := range weights {
+		if i/8 < len(mask) && mask[i/8]&(byte(1)<<uint(i%8)) != 0 {
+			total += w
+		}
+	}
+	return total
+}
+
 // DefaultSubLeaders returns the number of sub-leaders, which is the
 // cube-root of the number of nodes.
 func DefaultSubLeaders(nodes int) int {
@@ -123,11 +191,30 @@ func NewBlsCosi(n *onet.TreeNodeInstance, vf VerificationFn, subProtocolName str
 		verificationFn:    vf,
 		subProtocolName:   subProtocolName,
 		suite:             suite,
+		stopped:           make(chan struct{}),
 	}
 
 	return c, nil
 }
 
+// SetSubleaders generates the subtrees from an explicit assignment of the
+// leaves to the subleaders, where the keys are the roster indexes of the
+// subleaders and the values the roster indexes of their leaves. Every node
+// of the roster but the root must be assigned exactly once.
+func (p *BlsCosi) SetSubleaders(assignment map[int][]int) error {
+	trees, err := NewBlsProtocolTreeFromAssignment(p.Tree(), assignment)
+	if err != nil {
+		return xerrors.Errorf("error in tree generation: %v", err)
+	}
+	if p.rootOnly() {
+		p.subTrees = []*onet.Tree{}
+		return nil
+	}
+
+	p.subTrees = trees
+	return nil
+}
+
 // SetNbrSubTree generates N new subtrees that will be used
 // for the protocol
 func (p *BlsCosi) SetNbrSubTree(nbr int) error {
@@ -137,7 +224,7 @@ func (p *BlsCosi) SetNbrSubTree(nbr int) error {
 	if nbr > len(p.Roster().List) {
 		return xerrors.New("cannot have more subtrees than nodes")
 	}
-	if p.Threshold == 1 || nbr <= 0 {
+	if p.rootOnly() {
 		p.subTrees = []*onet.Tree{}
 		return nil
 	}
@@ -151,23 +238,48 @@ func (p *BlsCosi) SetNbrSubTree(nbr int) error {
 	return nil
 }
 
-// Shutdown stops the protocol
+// Shutdown stops the protocol. When it is called before the end, the
+// collection of the responses is abandoned and no signature is produced.
 func (p *BlsCosi) Shutdown() error {
 	p.stoppedOnce.Do(func() {
+		close(p.stopped)
 		p.subProtocolsLock.Lock()
 		for _, subCosi := range p.subProtocols {
+			// sub protocols waiting for a free slot are not started yet
+			if subCosi == nil {
+				continue
+			}
 			// we're stopping the root thus it will stop the children
 			// by itself using a broadcasted message
 			subCosi.Shutdown()
 		}
 		p.subProtocolsLock.Unlock()
+		p.finalLock.Lock()
 		close(p.FinalSignature)
+		p.finalLock.Unlock()
 	})
 
 	log.Lvl3("BLS CoSi ends")
 	return nil
 }
 
+// Err returns the reason why the protocol stopped without producing a
+// signature, or nil if it didn't fail.
+func (p *BlsCosi) Err() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
+
+// fail records and logs the reason why the protocol won't produce a
+// signature.
+func (p *BlsCosi) fail(err error) {
+	p.errLock.Lock()
+	p.err = err
+	p.errLock.Unlock()
+	log.Error(err)
+}
+
 // Dispatch is not used for the main protocol
 func (p *BlsCosi) Dispatch() error {
 	// This protocol relies only on the start call to spin up sub-protocols
@@ -210,21 +322,29 @@ func (p *BlsCosi) runSubProtocols() {
 
 	// Verification of the data is done before contacting the children
 	if ok := p.verificationFn(p.Msg, p.Data); !ok {
-		// root should not fail the verification otherwise it would not have started the protocol
-		log.Errorf("verification failed on root node")
+		if !p.AllowRootRefusal {
+			// root should not fail the verification otherwise it would not have started the protocol
+			p.fail(ErrorRootRefused)
+			return
+		}
+		log.Lvl2(p.ServerIdentity(), "refused to sign, collecting the other signatures")
+		p.rootRefused = true
+	}
+	if p.isStopped() {
 		return
 	}
 
-	// start all subprotocols
+	// start the subprotocols, the remaining ones are started when a slot
+	// is available
 	p.subProtocolsLock.Lock()
 	p.subProtocols = make([]*SubBlsCosi, len(p.subTrees))
-	for i, tree := range p.subTrees {
+	for i, tree := range p.subTrees[:p.concurrentSubtrees()] {
 		log.Lvlf3("Invoking start sub protocol on %v", tree.Root.ServerIdentity)
 		var err error
 		p.subProtocols[i], err = p.startSubProtocol(tree)
 		if err != nil {
 			p.subProtocolsLock.Unlock()
-			log.Error(err)
+			p.fail(err)
 			return
 		}
 	}
@@ -233,8 +353,12 @@ func (p *BlsCosi) runSubProtocols() {
 
 	// Wait and collect all the signature responses
 	responses, err := p.collectSignatures()
+	if p.isStopped() {
+		log.Lvl3(p.ServerIdentity(), "stopped while collecting the responses")
+		return
+	}
 	if err != nil {
-		log.Error(err)
+		p.fail(err)
 		return
 	}
 
@@ -243,11 +367,25 @@ func (p *BlsCosi) runSubProtocols() {
 	// generate root signature
 	sig, err := p.generateSignature(responses)
 	if err != nil {
-		log.Error(err)
+		p.fail(err)
 		return
 	}
 
-	p.FinalSignature <- sig
+	p.finalLock.Lock()
+	defer p.finalLock.Unlock()
+	if !p.isStopped() {
+		p.FinalSignature <- sig
+	}
+}
+
+// isStopped returns true when the protocol has been shut down.
+func (p *BlsCosi) isStopped() bool {
+	select {
+	case <-p.stopped:
+		return true
+	default:
+		return false
+	}
 }
 
 // checkIntegrity checks if the protocol has been instantiated with
@@ -268,20 +406,83 @@ func (p *BlsCosi) checkIntegrity() error {
 	if p.Timeout < 500*time.Microsecond {
 		return fmt.Errorf("unrealistic timeout")
 	}
-	if p.Threshold > p.Tree().Size() {
+	if p.Weights != nil {
+		if len(p.Weights) != len(p.Roster().List) {
+			return fmt.Errorf("got %d weights for %d nodes", len(p.Weights), len(p.Roster().List))
+		}
+		for i, w := range p.Weights {
+			if w < 0 {
+				return fmt.Errorf("negative weight for node %d: %d", i, w)
+			}
+		}
+		if p.Threshold > p.totalWeight() {
+			return fmt.Errorf("threshold (%d) bigger than total weight (%d)", p.Threshold, p.totalWeight())
+		}
+	} else if p.Threshold > p.Tree().Size() {
 		return fmt.Errorf("threshold (%d) bigger than number of nodes (%d)", p.Threshold, p.Tree().Size())
 	}
 	if p.Threshold < 1 {
 		return fmt.Errorf("threshold of %d smaller than one node", p.Threshold)
 	}
+	if p.MaxConcurrentSubtrees < 0 {
+		return fmt.Errorf("negative number of concurrent subtrees: %d", p.MaxConcurrentSubtrees)
+	}
 
 	return nil
 }
 
-// checkFailureThreshold returns true when the number of failures
+// concurrentSubtrees returns the number of sub protocols that can run at the
+// same time.
+func (p *BlsCosi) concurrentSubtrees() int {
+	if p.MaxConcurrentSubtrees > 0 && p.MaxConcurrentSubtrees < len(p.subTrees) {
+		return p.MaxConcurrentSubtrees
+	}
+	return len(p.subTrees)
+}
+
+// weight returns the weight of the node at the roster index, which is one
+// when the nodes are not weighted.
+func (p *BlsCosi) weight(index int) int {
+	if p.Weights == nil {
+		return 1
+	}
+	if index < 0 || index >= len(p.Weights) {
+		return 0
+	}
+	return p.Weights[index]
+}
+
+// totalWeight returns the weight of the whole roster.
+func (p *BlsCosi) totalWeight() int {
+	if p.Weights == nil {
+		return len(p.Roster().List)
+	}
+	total := 0
+	for _, w := range p.Weights {
+		total += w
+	}
+	return total
+}
+
+// subtreeWeight returns the weight of the node and of its descendants.
+func (p *BlsCosi) subtreeWeight(tn *onet.TreeNode) int {
+	w := p.weight(tn.RosterIndex)
+	for _, c := range tn.Children {
+		w += p.subtreeWeight(c)
+	}
+	return w
+}
+
+// rootOnly returns true when the signature of the root is enough to reach
+// the threshold.
+func (p *BlsCosi) rootOnly() bool {
+	return p.Threshold <= p.weight(p.TreeNode().RosterIndex)
+}
+
+// checkFailureThreshold returns true when the number (or weight) of failures
 // is above the threshold
 func (p *BlsCosi) checkFailureThreshold(numFailure int) bool {
-	return numFailure > len(p.Roster().List)-p.Threshold
+	return numFailure > p.totalWeight()-p.Threshold
 }
 
 // startSubProtocol creates, parametrize and starts a subprotocol on a given tree
@@ -322,8 +523,52 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 	// force to stop pending selects in case of timeout or quick answers
 	defer func() { close(closeChan) }()
 
+	// the slots of the sub protocols already started are taken
+	slots := make(chan struct{}, p.concurrentSubtrees())
+	for i := 0; i < cap(slots); i++ {
+		slots <- struct{}{}
+	}
+
 	for i, subProtocol := range p.subProtocols {
 		go func(i int, subProtocol *SubBlsCosi) {
+			if subProtocol == nil {
+				select {
+				case slots <- struct{}{}:
+				case <-closeChan:
+					return
+				}
+			}
+			// free the slot for a waiting sub protocol
+			defer func() { <-slots }()
+
+			if subProtocol == nil {
+				select {
+				case <-closeChan:
+					// the collection ended while waiting for the slot
+					return
+				default:
+				}
+
+				var err error
+				subProtocol, err = p.startSubProtocol(p.subTrees[i])
+				if err != nil {
+					errChan <- fmt.Errorf("(subprotocol %v) error in starting of subprotocol: %s", i, err)
+					return
+				}
+
+				p.subProtocolsLock.Lock()
+				p.subProtocols[i] = subProtocol
+				p.subProtocolsLock.Unlock()
+				if p.isStopped() {
+					// started after the shutdown went through the sub protocols
+					subProtocol.Shutdown()
+					return
+				}
+			}
+
+			// every node of the subtree is tried once as the subleader
+			attempts := len(p.subTrees[i].Root.Children[0].Children) + 1
+
 			for {
 				// this select doesn't have any timeout because a global is used
 				// when aggregating the response. The close channel will act as
@@ -343,7 +588,8 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 						nodes = append(nodes, child.RosterIndex)
 					}
 
-					if len(nodes) < 2 || subleaderID > nodes[1] {
+					attempts--
+					if len(nodes) < 2 || attempts == 0 {
 						errChan <- fmt.Errorf("(subprotocol %v) failed with every subleader, ignoring this subtree",
 							i)
 						return
@@ -369,6 +615,10 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 					p.subProtocolsLock.Lock()
 					p.subProtocols[i] = subProtocol
 					p.subProtocolsLock.Unlock()
+					if p.isStopped() {
+						subProtocol.Shutdown()
+						return
+					}
 				case response := <-subProtocol.subResponse:
 					responsesChan <- response
 					return
@@ -383,7 +633,13 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 	numSignature := 0
 	numFailure := 0
 	timeout := time.After(p.Timeout)
-	for numSubProtocols > 0 && numSignature < p.Threshold-1 && !p.checkFailureThreshold(numFailure) {
+	// the root signs as well, unless it refused
+	rootWeight := p.weight(p.TreeNode().RosterIndex)
+	if p.rootRefused {
+		numFailure = rootWeight
+		rootWeight = 0
+	}
+	for numSubProtocols > 0 && numSignature < p.Threshold-rootWeight && !p.checkFailureThreshold(numFailure) {
 		select {
 		case res := <-responsesChan:
 			publics := p.Publics()
@@ -400,28 +656,37 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 			if public != nil {
 				if _, ok := responseMap[index]; !ok {
 					count := mask.CountEnabled()
+					if p.Weights != nil {
+						count = maskWeight(res.Mask, p.Weights)
+					}
 					numSignature += count
-					numFailure += res.SubtreeCount() + 1 - count
+					numFailure += p.subtreeWeight(res.TreeNode) - count
 
 					responseMap[index] = &res.Response
 				}
 			}
+		case <-p.stopped:
+			return nil, xerrors.New("protocol stopped")
 		case err := <-errChan:
 			err = fmt.Errorf("error in getting responses: %s", err)
 			return nil, err
 		case <-timeout:
 			// here we use the entire timeout so that the protocol won't take
 			// more than Timeout + root computation time
-			return nil, fmt.Errorf("not enough replies from nodes at timeout %v "+
-				"for Threshold %d, got %d responses for %d requests", p.Timeout,
-				p.Threshold, numSignature, len(p.Roster().List)-1)
+			return nil, xerrors.Errorf("not enough replies from nodes at timeout %v "+
+				"for Threshold %d, got %d responses for %d requests: %w", p.Timeout,
+				p.Threshold, numSignature, len(p.Roster().List)-1, ErrorTimeout)
 		}
 	}
 
 	if p.checkFailureThreshold(numFailure) {
-		return nil, fmt.Errorf("too many signature-refusals (got %d), "+
-			"the threshold of %d cannot be achieved",
-			numFailure, p.Threshold)
+		return nil, xerrors.Errorf("too many signature-refusals (got %d), "+
+			"the threshold of %d cannot be achieved: %w",
+			numFailure, p.Threshold, ErrorThresholdNotReached)
+	}
+	if numSignature < p.Threshold-rootWeight {
+		return nil, xerrors.Errorf("not enough signatures (got %d) for the threshold of %d: %w",
+			numSignature, p.Threshold, ErrorThresholdNotReached)
 	}
 
 	return responseMap, nil
@@ -432,6 +697,10 @@ func (p *BlsCosi) collectSignatures() (ResponseMap, error) {
 func (p *BlsCosi) generateSignature(responses ResponseMap) (BlsSignature, error) {
 	publics := p.Publics()
 
+	if p.rootRefused {
+		return p.makeAggregateResponse(p.suite, publics, responses)
+	}
+
 	//generate personal mask
 	personalMask, err := sign.NewMask(p.suite, publics, p.Public())
 	if err != nil {
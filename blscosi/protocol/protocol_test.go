@@ -5,19 +5,27 @@ import (
 	"flag"
 	"fmt"
 	"math"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/sign"
+	"go.dedis.ch/kyber/v3/sign/bls"
+	"go.dedis.ch/kyber/v3/util/random"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
 )
 
 const FailureProtocolName = "FailureProtocol"
 const FailureSubProtocolName = "FailureSubProtocol"
+const RefuseRootProtocolName = "RefuseRootProtocol"
+const SlowProtocolName = "SlowProtocol"
+const SlowSubProtocolName = "SlowSubProtocol"
 
 func NewFailureProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	vf := func(a, b []byte) bool { return true }
@@ -28,6 +36,57 @@ func NewFailureSubProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, err
 	return NewSubBlsCosi(n, vf, testSuite)
 }
 
+// NewRefuseRootProtocol refuses the proposal on the root only.
+func NewRefuseRootProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(a, b []byte) bool { return false }
+	return NewBlsCosi(n, vf, DefaultSubProtocolName, testSuite)
+}
+
+// slowVerifications records the verifications of the sub protocols of
+// SlowProtocol running at the same time.
+var slowVerifications = &concurrencyCounter{}
+
+func NewSlowProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(a, b []byte) bool { return true }
+	return NewBlsCosi(n, vf, SlowSubProtocolName, testSuite)
+}
+func NewSlowSubProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(a, b []byte) bool {
+		slowVerifications.enter()
+		defer slowVerifications.leave()
+		time.Sleep(100 * time.Millisecond)
+		return true
+	}
+	return NewSubBlsCosi(n, vf, testSuite)
+}
+
+type concurrencyCounter struct {
+	sync.Mutex
+	running int
+	max     int
+}
+
+func (c *concurrencyCounter) enter() {
+	c.Lock()
+	defer c.Unlock()
+	c.running++
+	if c.running > c.max {
+		c.max = c.running
+	}
+}
+
+func (c *concurrencyCounter) leave() {
+	c.Lock()
+	defer c.Unlock()
+	c.running--
+}
+
+func (c *concurrencyCounter) maximum() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.max
+}
+
 // Used for tests
 var testServiceID onet.ServiceID
 
@@ -38,6 +97,9 @@ var newProtocolMethods = map[string]func(*onet.TreeNodeInstance) (onet.ProtocolI
 	DefaultSubProtocolName: NewDefaultSubProtocol,
 	FailureProtocolName:    NewFailureProtocol,
 	FailureSubProtocolName: NewFailureSubProtocol,
+	RefuseRootProtocolName: NewRefuseRootProtocol,
+	SlowProtocolName:       NewSlowProtocol,
+	SlowSubProtocolName:    NewSlowSubProtocol,
 }
 
 func init() {
@@ -52,6 +114,15 @@ func init() {
 	_, err = onet.GlobalProtocolRegister(FailureSubProtocolName,
 		NewFailureSubProtocol)
 	log.ErrFatal(err)
+	_, err = onet.GlobalProtocolRegister(RefuseRootProtocolName,
+		NewRefuseRootProtocol)
+	log.ErrFatal(err)
+	_, err = onet.GlobalProtocolRegister(SlowProtocolName,
+		NewSlowProtocol)
+	log.ErrFatal(err)
+	_, err = onet.GlobalProtocolRegister(SlowSubProtocolName,
+		NewSlowSubProtocol)
+	log.ErrFatal(err)
 }
 
 var testSuite = pairing.NewSuiteBn256()
@@ -394,6 +465,175 @@ func runProtocolAllFailing(nbrNodes, nbrTrees, threshold int) (time.Time, error)
 	return time, nil
 }
 
+func TestProtocol_MaxConcurrentSubtrees(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	_, cosiProtocol := createProtocol(t, local, SlowProtocolName, 13)
+	cosiProtocol.Threshold = 13
+	cosiProtocol.MaxConcurrentSubtrees = 1
+	require.NoError(t, cosiProtocol.SetSubleaders(map[int][]int{1: {2, 3}, 4: {5, 6}, 7: {8, 9}, 10: {11, 12}}))
+	require.NoError(t, cosiProtocol.Start())
+
+	_, err := getAndVerifySignature(cosiProtocol, cosiProtocol.Msg, sign.NewThresholdPolicy(13))
+	require.NoError(t, err)
+	require.NoError(t, cosiProtocol.Err())
+	// only the three nodes of a single subtree verify at the same time
+	require.True(t, slowVerifications.maximum() <= 3, slowVerifications.maximum())
+
+	_, cosiProtocol = createProtocol(t, local, DefaultProtocolName, 1)
+	cosiProtocol.MaxConcurrentSubtrees = -1
+	require.Error(t, cosiProtocol.Start())
+}
+
+func TestProtocol_Weights(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// the root and the subleader are heavy enough without the leaves
+	weights := []int{4, 1, 1, 1, 4}
+	servers, cosiProtocol := createProtocol(t, local, DefaultProtocolName, 5)
+	cosiProtocol.Weights = weights
+	cosiProtocol.Threshold = 8
+	cosiProtocol.Timeout = 4 * time.Second
+	require.NoError(t, cosiProtocol.SetSubleaders(map[int][]int{4: {1, 2, 3}}))
+	for _, s := range servers[1:4] {
+		s.Pause()
+	}
+	require.NoError(t, cosiProtocol.Start())
+
+	sig, err := getAndVerifySignature(cosiProtocol, cosiProtocol.Msg, NewWeightPolicy(weights, 8))
+	require.NoError(t, err)
+	// two signers are not enough without the weights
+	publics := cosiProtocol.Roster().ServicePublics(testServiceName)
+	require.Error(t, sig.VerifyWithPolicy(testSuite, cosiProtocol.Msg, publics, sign.NewThresholdPolicy(3)))
+
+	for _, c := range []struct {
+		weights   []int
+		threshold int
+	}{
+		{[]int{1, 1}, 1},
+		{[]int{1, 1, 1, 1, -1}, 1},
+		{weights, 12},
+	} {
+		_, cosiProtocol = createProtocol(t, local, DefaultProtocolName, 5)
+		cosiProtocol.Weights = c.weights
+		cosiProtocol.Threshold = c.threshold
+		require.Error(t, cosiProtocol.Start())
+	}
+}
+
+func TestWeightPolicy(t *testing.T) {
+	publics := make([]kyber.Point, 4)
+	for i := range publics {
+		_, publics[i] = bls.NewKeyPair(testSuite, random.New())
+	}
+	mask, err := sign.NewMask(testSuite, publics, nil)
+	require.NoError(t, err)
+	require.NoError(t, mask.SetBit(3, true))
+
+	policy := NewWeightPolicy([]int{1, 1, 1, 3}, 4)
+	require.False(t, policy.Check(mask))
+	require.NoError(t, mask.SetBit(0, true))
+	require.True(t, policy.Check(mask))
+
+	// the weights can't be found without the bits of a sign.Mask
+	require.False(t, policy.Check(countMask{enabled: 4, total: 4}))
+}
+
+// countMask is a participation mask that only gives the counts.
+type countMask struct {
+	enabled, total int
+}
+
+func (m countMask) CountEnabled() int { return m.enabled }
+func (m countMask) CountTotal() int   { return m.total }
+
+func TestProtocol_AllowRootRefusal(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// the root stops the protocol by default
+	_, cosiProtocol := createProtocol(t, local, RefuseRootProtocolName, 4)
+	cosiProtocol.Threshold = 3
+	require.NoError(t, cosiProtocol.Start())
+	err := getError(t, cosiProtocol)
+	require.True(t, xerrors.Is(err, ErrorRootRefused), err)
+
+	// or the others sign without it
+	_, cosiProtocol = createProtocol(t, local, RefuseRootProtocolName, 4)
+	cosiProtocol.Threshold = 3
+	cosiProtocol.AllowRootRefusal = true
+	require.NoError(t, cosiProtocol.Start())
+
+	sig, err := getAndVerifySignature(cosiProtocol, cosiProtocol.Msg, sign.NewThresholdPolicy(3))
+	require.NoError(t, err)
+	publics := cosiProtocol.Roster().ServicePublics(testServiceName)
+	mask, err := sig.GetMask(testSuite, publics)
+	require.NoError(t, err)
+	require.Equal(t, -1, mask.NthEnabledAtIndex(0))
+}
+
+func TestProtocol_ErrorThresholdNotReached(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// every node but the root refuses
+	_, cosiProtocol := createProtocol(t, local, FailureProtocolName, 4)
+	cosiProtocol.Threshold = 2
+	require.NoError(t, cosiProtocol.Start())
+	err := getError(t, cosiProtocol)
+	require.True(t, xerrors.Is(err, ErrorThresholdNotReached), err)
+}
+
+func TestProtocol_ErrorTimeout(t *testing.T) {
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// every node but the root is offline and the protocol gives up before
+	// trying the second subleader
+	servers, cosiProtocol := createProtocol(t, local, DefaultProtocolName, 3)
+	cosiProtocol.Threshold = 3
+	cosiProtocol.Timeout = time.Second
+	cosiProtocol.SubleaderFailures = 0
+	require.NoError(t, cosiProtocol.SetNbrSubTree(1))
+	for _, s := range servers[1:] {
+		s.Pause()
+	}
+	require.NoError(t, cosiProtocol.Start())
+	err := getError(t, cosiProtocol)
+	require.True(t, xerrors.Is(err, ErrorTimeout), err)
+}
+
+// createProtocol returns the root protocol of a new tree of nbrNodes nodes,
+// ready to be started.
+func createProtocol(t *testing.T, local *onet.LocalTest, name string, nbrNodes int) ([]*onet.Server, *BlsCosi) {
+	servers, _, tree := local.GenTree(nbrNodes, false)
+	services := local.GetServices(servers, testServiceID)
+
+	rootService := services[0].(*testService)
+	pi, err := rootService.CreateProtocol(name, tree)
+	require.NoError(t, err)
+
+	cosiProtocol := pi.(*BlsCosi)
+	cosiProtocol.CreateProtocol = rootService.CreateProtocol
+	cosiProtocol.Msg = []byte{0xFF}
+	cosiProtocol.Timeout = testTimeout
+	return servers, cosiProtocol
+}
+
+// getError waits for the protocol to stop without a signature and returns
+// the reason.
+func getError(t *testing.T, proto *BlsCosi) error {
+	select {
+	case sig := <-proto.FinalSignature:
+		require.Nil(t, sig)
+	case <-time.After(testTimeout * 2):
+		require.Fail(t, "didn't stop in time")
+	}
+	return proto.Err()
+}
+
 // testService allows setting the pairing keys of the protocol.
 type testService struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
@@ -438,10 +678,10 @@ func (s *testService) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericC
 		return nil, err
 	}
 	switch tn.ProtocolName() {
-	case DefaultProtocolName, FailureProtocolName:
+	case DefaultProtocolName, FailureProtocolName, RefuseRootProtocolName, SlowProtocolName:
 		blscosi := pi.(*BlsCosi)
 		return blscosi, nil
-	case DefaultSubProtocolName, FailureSubProtocolName:
+	case DefaultSubProtocolName, FailureSubProtocolName, SlowSubProtocolName:
 		subblscosi := pi.(*SubBlsCosi)
 		return subblscosi, nil
 	}
@@ -78,6 +78,23 @@ func (sig BlsSignature) Verify(ps pairing.Suite, msg []byte, publics []kyber.Poi
 
 // VerifyWithPolicy checks the signature over the message using the given public keys and policy.
 func (sig BlsSignature) VerifyWithPolicy(ps pairing.Suite, msg []byte, publics []kyber.Point, policy sign.Policy) error {
+	return sig.VerifyWithAggregateKey(ps, msg, publics, policy, AggregatePublicKeys)
+}
+
+// AggregateKeyFn returns the aggregate public key of the participants of the
+// mask. It lets the caller reuse a key computed for a previous signature.
+type AggregateKeyFn func(suite pairing.Suite, mask *sign.Mask) (kyber.Point, error)
+
+// AggregatePublicKeys is the AggregateKeyFn of BLS signatures.
+func AggregatePublicKeys(suite pairing.Suite, mask *sign.Mask) (kyber.Point, error) {
+	return bls.AggregatePublicKeys(suite, mask.Participants()...), nil
+}
+
+// VerifyWithAggregateKey checks the signature over the message using the
+// given public keys and policy, and the aggregate public key of the signers
+// given by the aggregate function.
+func (sig BlsSignature) VerifyWithAggregateKey(ps pairing.Suite, msg []byte, publics []kyber.Point,
+	policy sign.Policy, aggregate AggregateKeyFn) error {
 	if publics == nil || len(publics) == 0 {
 		return errors.New("no public keys provided")
 	}
@@ -89,6 +106,9 @@ func (sig BlsSignature) VerifyWithPolicy(ps pairing.Suite, msg []byte, publics [
 	}
 
 	lenCom := ps.G1().PointLen()
+	if len(sig) < lenCom {
+		return errors.New("invalid signature length")
+	}
 	signature := sig[:lenCom]
 
 	// Unpack the participation mask and get the aggregate public key
@@ -97,8 +117,10 @@ func (sig BlsSignature) VerifyWithPolicy(ps pairing.Suite, msg []byte, publics [
 		return err
 	}
 
-	pubs := mask.Participants()
-	aggPub := bls.AggregatePublicKeys(ps, pubs...)
+	aggPub, err := aggregate(ps, mask)
+	if err != nil {
+		return err
+	}
 
 	err = bls.Verify(ps, aggPub, msg, signature)
 	if err != nil {
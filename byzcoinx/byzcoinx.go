@@ -8,6 +8,7 @@ package byzcoinx
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
@@ -16,8 +17,27 @@ import (
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
 )
 
+// ErrorThresholdNotReached is reported when a phase ends without gathering
+// enough signatures to reach the threshold.
+var ErrorThresholdNotReached = xerrors.New("threshold not reached")
+
+// ErrorTimeout is reported when a phase doesn't finish in time.
+var ErrorTimeout = xerrors.New("timeout while waiting for the signature")
+
+// ErrorLeaderSignatureMissing is reported when the leader is required to
+// sign but is not among the signers.
+var ErrorLeaderSignatureMissing = xerrors.New("leader signature missing")
+
+// ErrorLeaderRefused is reported when the verification of the leader refuses
+// the proposal and the leader refusal is not allowed.
+var ErrorLeaderRefused = xerrors.New("leader refused the proposal")
+
+// ErrorCancelled is reported when the protocol is shut down before the end.
+var ErrorCancelled = xerrors.New("protocol cancelled")
+
 // ByzCoinX contains the state used to execute two rounds of blscosi.
 type ByzCoinX struct {
 	// the node we are represented-in
@@ -28,6 +48,11 @@ type ByzCoinX struct {
 	Data []byte
 	// FinalSignature is output of the protocol, for the caller to read
 	FinalSignatureChan chan FinalSignature
+	// ErrorChan is optional and receives the reason of a failure. When it
+	// is set, a run writes either a valid signature to FinalSignatureChan
+	// or an error to ErrorChan, otherwise failures are reported with an
+	// empty signature. It must be buffered.
+	ErrorChan chan error
 	// CreateProtocol stores a function pointer used to create the ftcosi
 	// protocol
 	CreateProtocol protocol.CreateProtocolFunction
@@ -37,14 +62,51 @@ type ByzCoinX struct {
 	// SubleaderFailures is the maximum number of attempts
 	// when subleaders are failing
 	SubleaderFailures int
-	// Threshold is the number of nodes to reach for a signature to be valid
+	// Threshold is the number of nodes to reach for a signature to be valid,
+	// or the total weight of the signers when Weights is set
 	Threshold int
+	// VerifyCacheTTL, when positive, is how long the leader remembers that
+	// its verification function accepted this Msg and Data in the prepare
+	// phase, so that proposing them again skips that verification on the
+	// leader only. A refusal is not remembered and the acknowledgement of the
+	// commit phase always runs. Zero drops the cached verdict. The other
+	// nodes run their verification every time.
+	VerifyCacheTTL time.Duration
+	// Weights, when set, gives the weight of each node of the roster, in the
+	// same order. The Threshold is then the minimum total weight of the
+	// signers instead of their number, and the signatures are verified
+	// against it.
+	Weights []int
+	// RequireLeaderSignature makes the round fail when the leader doesn't
+	// sign, even if the threshold is reached.
+	RequireLeaderSignature bool
+	// AllowLeaderRefusal lets the other nodes sign the proposal when the
+	// verification of the leader refuses it, the leader being counted as a
+	// failure. By default a refusal of the leader stops the round with
+	// ErrorLeaderRefused. It is ignored when RequireLeaderSignature is set.
+	AllowLeaderRefusal bool
+	// IncludeData makes the final signature carry the Data of the round so
+	// that the verification can be run again from the signature alone.
+	IncludeData bool
+	// Store, when set, keeps a checkpoint of the round after the prepare
+	// phase. A leader restarting the round for the same Msg and Data then
+	// resumes it from the commit phase. Only a finished prepare phase is
+	// kept, the responses collected during a phase are not, so the commit
+	// phase always runs again in full. The checkpoint is removed at the end
+	// of the round, unless it is cancelled.
+	Store ProtocolStore
+	// MaxConcurrentSubtrees is the maximum number of subtrees running at the
+	// same time during a phase, zero meaning no limit. It bounds the
+	// resources used by the leader for large rosters but the subtrees are
+	// then contacted one batch after the other, so the Timeout needs to grow
+	// with the number of batches.
+	MaxConcurrentSubtrees int
 	// prepCosiProtoName is the ftcosi protocol name for the prepare phase
 	prepCosiProtoName string
 	// commitCosiProtoName is the ftcosi protocol name for the commit phase
 	commitCosiProtoName string
 	// prepSigChan is the channel for reading the prepare phase signature
-	prepSigChan chan []byte
+	prepSigChan chan phaseResult
 	// publics is the list of public keys
 	publics []kyber.Point
 	// suite is the ftcosi.Suite, which may be different from the suite used
@@ -53,19 +115,48 @@ type ByzCoinX struct {
 	suite *pairing.SuiteBn256
 	// nSubtrees is the number of subtrees used for the ftcosi protocols.
 	nSubtrees int
+	// subleaders is the explicit assignment of the leaves to the subleaders,
+	// nil to let the cosi protocols generate the subtrees
+	subleaders map[int][]int
 	// verifySignature takes the given signature and verifies it against
 	// the message
 	verifier VerifierFn
+	// policyVerifier verifies the signature against a given policy and is
+	// used instead of the verifier when the nodes are weighted
+	policyVerifier policyVerifierFn
+	// verdicts holds the verdicts of the prepare verification run by the
+	// leader, shared by the instances of the protocol
+	verdicts *verdictCache
+	// closing is closed when the protocol shuts down
+	closing     chan struct{}
+	closingOnce sync.Once
+	// cosi is the cosi protocol of the running phase, shut down with the
+	// protocol
+	cosi     *protocol.BlsCosi
+	cosiLock sync.Mutex
 }
 
 // FinalSignature holds the message Msg and its signature
 type FinalSignature struct {
 	Msg []byte
 	Sig []byte
+	// Data is the verification data of the round, only set when
+	// ByzCoinX.IncludeData is. It is given to the verification functions
+	// with Msg but is not covered by the signature.
+	Data []byte `protobuf:"opt"`
 }
 
 type phase int
 
+// phaseResult is the outcome of the cosi protocol of a phase.
+type phaseResult struct {
+	sig []byte
+	err error
+	// notStarted is set when Start failed, the error being already returned
+	// to the caller
+	notStarted bool
+}
+
 // VerifierFn is used to verify the final signature
 type VerifierFn func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point) error
 
@@ -75,13 +166,62 @@ const (
 )
 
 // Start begins the BFTCoSi protocol by starting the prepare ftcosi.
-func (bft *ByzCoinX) Start() error {
+func (bft *ByzCoinX) Start() (err error) {
+	defer func() {
+		if err != nil {
+			// Dispatch must not wait for a prepare phase that won't happen
+			select {
+			case bft.prepSigChan <- phaseResult{err: err, notStarted: true}:
+			default:
+			}
+		}
+	}()
+
 	if bft.CreateProtocol == nil {
 		return fmt.Errorf("no CreateProtocol")
 	}
 	if bft.FinalSignatureChan == nil {
 		return fmt.Errorf("no FinalSignatureChan")
 	}
+	if bft.MaxConcurrentSubtrees < 0 {
+		return fmt.Errorf("negative MaxConcurrentSubtrees: %d", bft.MaxConcurrentSubtrees)
+	}
+	if bft.Weights != nil {
+		if len(bft.Weights) != len(bft.publics) {
+			return fmt.Errorf("got %d weights for %d nodes", len(bft.Weights), len(bft.publics))
+		}
+		if bft.policyVerifier == nil {
+			return fmt.Errorf("the verifier doesn't support weights")
+		}
+		total := 0
+		for i, w := range bft.Weights {
+			if w < 0 {
+				return fmt.Errorf("negative weight for node %d: %d", i, w)
+			}
+			total += w
+		}
+		if bft.Threshold > total {
+			return fmt.Errorf("threshold (%d) bigger than total weight (%d)", bft.Threshold, total)
+		}
+	} else if bft.Threshold > len(bft.publics) {
+		return fmt.Errorf("threshold (%d) bigger than number of nodes (%d)", bft.Threshold, len(bft.publics))
+	}
+	if bft.Threshold < 1 {
+		return fmt.Errorf("threshold of %d smaller than one node", bft.Threshold)
+	}
+	if bft.verdicts != nil {
+		if bft.VerifyCacheTTL > 0 {
+			bft.verdicts.enable(bft.Msg, bft.Data, bft.VerifyCacheTTL)
+		} else {
+			bft.verdicts.disable(bft.Msg, bft.Data)
+		}
+	}
+
+	if state := bft.loadCheckpoint(); state != nil {
+		log.Lvl2(bft.ServerIdentity(), "Resuming the round after the prepare phase")
+		bft.prepSigChan <- phaseResult{sig: state.PrepareSig}
+		return nil
+	}
 
 	// prepare phase (part 1)
 	log.Lvl3("Starting prepare phase")
@@ -90,26 +230,120 @@ func (bft *ByzCoinX) Start() error {
 		return err
 	}
 
-	err = prepProto.Start()
+	err = bft.startCosi(prepProto)
 	if err != nil {
 		return err
 	}
 
 	go func() {
-		select {
-		case tmpSig := <-prepProto.FinalSignature:
-			bft.prepSigChan <- tmpSig
-		case <-time.After(bft.Timeout / time.Duration(2) * time.Duration(bft.SubleaderFailures+1)):
-			// Waiting for bft.Timeout is too long here but used as a safeguard in
-			// case the prepProto does not return in time.
-			log.Error(bft.ServerIdentity().Address, "timeout should not happen while waiting for signature")
-			bft.prepSigChan <- nil
-		}
+		sig, err := bft.waitSignature(prepProto)
+		bft.prepSigChan <- phaseResult{sig: sig, err: err}
 	}()
 
 	return nil
 }
 
+// waitSignature waits for the cosi protocol of a phase to finish and returns
+// its signature, or the reason why there is none.
+func (bft *ByzCoinX) waitSignature(cosiProto *protocol.BlsCosi) ([]byte, error) {
+	select {
+	case sig := <-cosiProto.FinalSignature:
+		if sig != nil {
+			return sig, nil
+		}
+		// the channel is closed when the protocol stops without a signature
+		err := cosiProto.Err()
+		if err == nil {
+			return nil, ErrorCancelled
+		}
+		if xerrors.Is(err, protocol.ErrorTimeout) {
+			return nil, xerrors.Errorf("%v: %w", err, ErrorTimeout)
+		}
+		if xerrors.Is(err, protocol.ErrorRootRefused) {
+			if bft.RequireLeaderSignature {
+				return nil, xerrors.Errorf("%v: %w", err, ErrorLeaderSignatureMissing)
+			}
+			return nil, xerrors.Errorf("%v: %w", err, ErrorLeaderRefused)
+		}
+		if xerrors.Is(err, protocol.ErrorThresholdNotReached) {
+			return nil, xerrors.Errorf("%v: %w", err, ErrorThresholdNotReached)
+		}
+		return nil, err
+	case <-time.After(bft.Timeout / time.Duration(2) * time.Duration(bft.SubleaderFailures+1)):
+		// Waiting for bft.Timeout is too long here but used as a safeguard in
+		// case the cosi protocol does not return in time.
+		log.Error(bft.ServerIdentity().Address, "timeout should not happen while waiting for signature")
+		return nil, ErrorTimeout
+	case <-bft.closing:
+		return nil, ErrorCancelled
+	}
+}
+
+// fail reports the failure of the run to the caller.
+func (bft *ByzCoinX) fail(err error) {
+	if bft.ErrorChan != nil {
+		bft.ErrorChan <- err
+		return
+	}
+	bft.FinalSignatureChan <- FinalSignature{}
+}
+
+// InvalidateVerifyCache drops the verdicts cached by the leader for every
+// proposal, so that they are verified again the next time.
+func (bft *ByzCoinX) InvalidateVerifyCache() {
+	if bft.verdicts != nil {
+		bft.verdicts.invalidate()
+	}
+}
+
+// SetSubleaders replaces the automatic generation of the subtrees by an
+// explicit assignment, where the keys are the roster indexes of the
+// subleaders and the values the roster indexes of their leaves. The
+// assignment must cover every node of the roster but the root exactly once.
+// When a subleader fails, the first of its leaves takes its place as usual.
+func (bft *ByzCoinX) SetSubleaders(assignment map[int][]int) error {
+	_, err := protocol.NewBlsProtocolTreeFromAssignment(bft.Tree(), assignment)
+	if err != nil {
+		return fmt.Errorf("invalid subleaders: %v", err)
+	}
+
+	bft.subleaders = assignment
+	bft.nSubtrees = len(assignment)
+	return nil
+}
+
+// Shutdown stops the cosi protocol of the running phase. If the run isn't
+// finished yet, it is reported as cancelled.
+func (bft *ByzCoinX) Shutdown() error {
+	bft.closingOnce.Do(func() {
+		close(bft.closing)
+	})
+
+	bft.cosiLock.Lock()
+	defer bft.cosiLock.Unlock()
+	if bft.cosi != nil {
+		return bft.cosi.Shutdown()
+	}
+	return nil
+}
+
+// startCosi starts the cosi protocol of a phase and keeps it to stop it on
+// shutdown. It isn't started when the protocol is already shut down.
+func (bft *ByzCoinX) startCosi(cosiProto *protocol.BlsCosi) error {
+	bft.cosiLock.Lock()
+	defer bft.cosiLock.Unlock()
+
+	select {
+	case <-bft.closing:
+		cosiProto.Done()
+		return ErrorCancelled
+	default:
+	}
+
+	bft.cosi = cosiProto
+	return cosiProto.Start()
+}
+
 func (bft *ByzCoinX) initCosiProtocol(phase phase) (*protocol.BlsCosi, error) {
 	var name string
 	if phase == phasePrep {
@@ -129,6 +363,9 @@ func (bft *ByzCoinX) initCosiProtocol(phase phase) (*protocol.BlsCosi, error) {
 	cosiProto.Msg = bft.Msg
 	cosiProto.Data = bft.Data
 	cosiProto.Threshold = bft.Threshold
+	cosiProto.Weights = bft.Weights
+	cosiProto.AllowRootRefusal = bft.AllowLeaderRefusal && !bft.RequireLeaderSignature
+	cosiProto.MaxConcurrentSubtrees = bft.MaxConcurrentSubtrees
 	// For each of the prepare and commit phase we get half of the time.
 	cosiProto.Timeout = bft.Timeout / 2
 
@@ -142,10 +379,24 @@ func (bft *ByzCoinX) initCosiProtocol(phase phase) (*protocol.BlsCosi, error) {
 		//   ( nodes - root - 1 )
 		bft.SubleaderFailures = (bft.Tree().Size() - 2) /
 			bft.nSubtrees
+		for _, leaves := range bft.subleaders {
+			if len(leaves) > bft.SubleaderFailures {
+				bft.SubleaderFailures = len(leaves)
+			}
+		}
 	}
 	cosiProto.SubleaderFailures = bft.SubleaderFailures
 
-	return cosiProto, cosiProto.SetNbrSubTree(bft.nSubtrees)
+	if bft.subleaders != nil {
+		err = cosiProto.SetSubleaders(bft.subleaders)
+	} else {
+		err = cosiProto.SetNbrSubTree(bft.nSubtrees)
+	}
+	if err != nil {
+		cosiProto.Done()
+		return nil, err
+	}
+	return cosiProto, nil
 }
 
 // Dispatch is the main logic of the BFTCoSi protocol. It runs two CoSi
@@ -165,47 +416,89 @@ func (bft *ByzCoinX) Dispatch() error {
 
 	log.Lvl2(bft.ServerIdentity(), "Starting prepare phase")
 	// prepare phase (part 2)
-	prepSig := <-bft.prepSigChan
-	err := bft.verifier(bft.suite, bft.Msg, prepSig, bft.publics)
+	prep := <-bft.prepSigChan
+	if prep.notStarted {
+		return nil
+	}
+	if prep.err != nil {
+		log.Lvl2("Prepare phase failed with error:", prep.err)
+		bft.fail(prep.err)
+		return nil
+	}
+	err := bft.verifySignature(prep.sig)
 	if err != nil {
 		log.Lvl2("Signature verification failed on root during the prepare phase with error:", err)
-		bft.FinalSignatureChan <- FinalSignature{nil, nil}
+		bft.clearCheckpoint()
+		bft.fail(xerrors.Errorf("prepare signature is wrong: %w", err))
 		return nil
 	}
+	bft.saveCheckpoint(prep.sig)
 	log.Lvl2(bft.ServerIdentity(), "Finished prepare phase")
 
 	// commit phase
 	log.Lvl2(bft.ServerIdentity(), "Starting commit phase")
 	commitProto, err := bft.initCosiProtocol(phaseCommit)
-	if err != nil {
-		return err
+	if err == nil {
+		err = bft.startCosi(commitProto)
 	}
-
-	err = commitProto.Start()
 	if err != nil {
-		return err
+		if xerrors.Is(err, ErrorCancelled) {
+			bft.fail(err)
+			return nil
+		}
+		bft.clearCheckpoint()
+		bft.fail(err)
+		return fmt.Errorf("couldn't start the commit phase: %v", err)
 	}
 
-	var commitSig []byte
-	select {
-	case commitSig = <-commitProto.FinalSignature:
-		log.Lvl2(bft.ServerIdentity(), "Finished commit phase")
-	case <-time.After(bft.Timeout / time.Duration(2) * time.Duration(bft.SubleaderFailures+1)):
-		// Waiting for bft.Timeout is too long here but used as a safeguard in
-		// case the commitProto does not return in time.
-		log.Error(bft.ServerIdentity().Address, "timeout should not happen while waiting for signature")
+	commitSig, err := bft.waitSignature(commitProto)
+	if err != nil {
+		if xerrors.Is(err, ErrorCancelled) {
+			// the checkpoint is kept to resume the round
+			bft.fail(err)
+			return nil
+		}
+		bft.clearCheckpoint()
+		bft.fail(err)
+		return fmt.Errorf("commit phase failed: %v", err)
 	}
+	log.Lvl2(bft.ServerIdentity(), "Finished commit phase")
 
-	err = bft.verifier(bft.suite, bft.Msg, commitSig, bft.publics)
+	bft.clearCheckpoint()
+	err = bft.verifySignature(commitSig)
 	if err != nil {
-		bft.FinalSignatureChan <- FinalSignature{nil, nil}
+		bft.fail(xerrors.Errorf("commit signature is wrong: %w", err))
 		return errors.New("commit signature is wrong")
 	}
 
-	bft.FinalSignatureChan <- FinalSignature{bft.Msg, commitSig}
+	final := FinalSignature{Msg: bft.Msg, Sig: commitSig}
+	if bft.IncludeData {
+		final.Data = bft.Data
+	}
+	bft.FinalSignatureChan <- final
 	return nil
 }
 
+// verifySignature checks the signature of a phase, against the weight
+// threshold when the nodes are weighted.
+func (bft *ByzCoinX) verifySignature(sig []byte) error {
+	if bft.RequireLeaderSignature {
+		mask, err := protocol.BlsSignature(sig).GetMask(bft.suite, bft.publics)
+		if err != nil {
+			return err
+		}
+		if mask.NthEnabledAtIndex(bft.TreeNode().RosterIndex) < 0 {
+			return ErrorLeaderSignatureMissing
+		}
+	}
+
+	if bft.Weights == nil {
+		return bft.verifier(bft.suite, bft.Msg, sig, bft.publics)
+	}
+	policy := protocol.NewWeightPolicy(bft.Weights, bft.Threshold)
+	return bft.policyVerifier(bft.suite, bft.Msg, sig, bft.publics, policy)
+}
+
 // NewByzCoinX creates and initialises a ByzCoinX protocol.
 func NewByzCoinX(n *onet.TreeNodeInstance, prepCosiProtoName, commitCosiProtoName string,
 	suite *pairing.SuiteBn256, verifier VerifierFn) (*ByzCoinX, error) {
@@ -216,11 +509,12 @@ func NewByzCoinX(n *onet.TreeNodeInstance, prepCosiProtoName, commitCosiProtoNam
 		Data:                make([]byte, 0),
 		prepCosiProtoName:   prepCosiProtoName,
 		commitCosiProtoName: commitCosiProtoName,
-		prepSigChan:         make(chan []byte, 0),
+		prepSigChan:         make(chan phaseResult, 1),
 		publics:             n.Publics(),
 		suite:               suite,
 		verifier:            verifier,
 		nSubtrees:           protocol.DefaultSubLeaders(len(n.List())),
+		closing:             make(chan struct{}),
 	}, nil
 }
 
@@ -233,15 +527,28 @@ func makeProtocols(vf, ack protocol.VerificationFn, protoName string, suite *pai
 	commitCosiProtoName := protoName + "_cosi_commit"
 	commitCosiSubProtoName := protoName + "_subcosi_commit"
 
-	verifier := func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point) error {
-		return protocol.BlsSignature(sig).Verify(suite, msg, pubkeys)
-	}
+	// the aggregate public keys are shared by all the instances of the
+	// protocol so that rounds over the same signers skip the aggregation
+	aggKeys := newLRUCache(aggregateKeyCacheSize)
+
+	verdicts := newVerdictCache()
 
 	protocolMap[protoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-		return NewByzCoinX(n, prepCosiProtoName, commitCosiProtoName, suite, verifier)
+		rk, err := rosterKey(n.Publics())
+		if err != nil {
+			return nil, err
+		}
+		verifier := newBlsVerifier(aggKeys, rk)
+		bft, err := NewByzCoinX(n, prepCosiProtoName, commitCosiProtoName, suite, verifier.withDefaultPolicy())
+		if err != nil {
+			return nil, err
+		}
+		bft.policyVerifier = verifier
+		bft.verdicts = verdicts
+		return bft, nil
 	}
 	protocolMap[prepCosiProtoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-		return protocol.NewBlsCosi(n, vf, prepCosiSubProtoName, suite)
+		return protocol.NewBlsCosi(n, verdicts.wrap(vf), prepCosiSubProtoName, suite)
 	}
 	protocolMap[prepCosiSubProtoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		return protocol.NewSubBlsCosi(n, vf, suite)
@@ -264,15 +571,26 @@ func makeBdnProtocols(vf, ack protocol.VerificationFn, protoName string, suite *
 	commitCosiProtoName := protoName + "_cosi_commit"
 	commitCosiSubProtoName := protoName + "_subcosi_commit"
 
-	verifier := func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point) error {
-		return bdnproto.BdnSignature(sig).Verify(suite, msg, pubkeys)
-	}
+	aggKeys := newLRUCache(aggregateKeyCacheSize)
+
+	verdicts := newVerdictCache()
 
 	protocolMap[protoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-		return NewByzCoinX(n, prepCosiProtoName, commitCosiProtoName, suite, verifier)
+		rk, err := rosterKey(n.Publics())
+		if err != nil {
+			return nil, err
+		}
+		verifier := newBdnVerifier(aggKeys, rk)
+		bft, err := NewByzCoinX(n, prepCosiProtoName, commitCosiProtoName, suite, verifier.withDefaultPolicy())
+		if err != nil {
+			return nil, err
+		}
+		bft.policyVerifier = verifier
+		bft.verdicts = verdicts
+		return bft, nil
 	}
 	protocolMap[prepCosiProtoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-		return bdnproto.NewBdnCosi(n, vf, prepCosiSubProtoName, suite)
+		return bdnproto.NewBdnCosi(n, verdicts.wrap(vf), prepCosiSubProtoName, suite)
 	}
 	protocolMap[prepCosiSubProtoName] = func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 		return bdnproto.NewSubBdnCosi(n, vf, suite)
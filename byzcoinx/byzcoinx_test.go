@@ -7,6 +7,7 @@ import (
 	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +18,8 @@ import (
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
 )
 
 var defaultTimeout = 20 * time.Second
@@ -173,22 +176,539 @@ func TestBftCoSiFault(t *testing.T) {
 	}
 }
 
+func TestBftCoSiMaxConcurrentSubtrees(t *testing.T) {
+	const protoName = "TestBftCoSiMaxConcurrentSubtrees"
+
+	// records the verifications running at the same time
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	slowVerify := func(msg, data []byte) bool {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return true
+	}
+	err := GlobalInitBFTCoSiProtocol(testSuite, slowVerify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	bft, _ := startProtocol(t, local, 20, 0, 0, protoName, func(bft *ByzCoinX) {
+		require.NoError(t, bft.SetSubleaders(map[int][]int{
+			1: {2, 3, 4, 5}, 6: {7, 8, 9, 10}, 11: {12, 13, 14, 15}, 16: {17, 18, 19},
+		}))
+		bft.MaxConcurrentSubtrees = 1
+		// the subtrees are contacted one after the other
+		bft.Timeout = defaultTimeout * time.Duration(bft.nSubtrees)
+	})
+	sig := getSignature(t, bft)
+	require.NoError(t, protocol.BlsSignature(sig.Sig).Verify(testSuite, bft.Msg, bft.Roster().Publics()))
+	// at most the five nodes of a single subtree verify at the same time,
+	// the leader verifying before the subtrees are contacted
+	lock.Lock()
+	require.True(t, maxRunning <= 5, maxRunning)
+	lock.Unlock()
+
+	// a negative limit is rejected before anything starts
+	bft = &ByzCoinX{
+		CreateProtocol: func(string, *onet.Tree) (onet.ProtocolInstance, error) {
+			return nil, nil
+		},
+		FinalSignatureChan:    make(chan FinalSignature, 1),
+		MaxConcurrentSubtrees: -1,
+	}
+	require.Error(t, bft.Start())
+}
+
+func TestBftCoSiSetSubleaders(t *testing.T) {
+	const protoName = "TestBftCoSiSetSubleaders"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// the last server is offline and designated as the first subleader, so
+	// its first leaf takes over the subtree
+	bft, counter := startProtocol(t, local, 7, 1, 0, protoName, func(bft *ByzCoinX) {
+		require.Error(t, bft.SetSubleaders(map[int][]int{6: {1, 2}, 3: {4}}))
+		require.Error(t, bft.SetSubleaders(map[int][]int{6: {1, 2}, 3: {4, 5, 2}}))
+		require.NoError(t, bft.SetSubleaders(map[int][]int{6: {1, 2}, 3: {4, 5}}))
+	})
+
+	publics := bft.Roster().Publics()
+	sig := getSignature(t, bft)
+	require.NoError(t, protocol.BlsSignature(sig.Sig).Verify(testSuite, bft.Msg, publics))
+
+	// every node but the failing subleader signed
+	mask, err := protocol.BlsSignature(sig.Sig).GetMask(testSuite, publics)
+	require.NoError(t, err)
+	require.Equal(t, 6, mask.CountEnabled())
+	require.Equal(t, 5, mask.IndexOfNthEnabled(5))
+
+	counter.Lock()
+	require.True(t, 6 <= counter.veriCount)
+	counter.Unlock()
+}
+
+func TestBftCoSiWeights(t *testing.T) {
+	const protoName = "TestBftCoSiWeights"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	// the two heavy nodes are enough when the four light ones are offline
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+	weights := []int{4, 4, 1, 1, 1, 1}
+	bft, _ := startProtocol(t, local, 6, 4, 0, protoName, func(bft *ByzCoinX) {
+		bft.Weights = weights
+		bft.Threshold = 8
+	})
+
+	sig := getSignature(t, bft)
+	publics := bft.Roster().Publics()
+	policy := protocol.NewWeightPolicy(weights, 8)
+	require.NoError(t, protocol.BlsSignature(sig.Sig).VerifyWithPolicy(testSuite, bft.Msg, publics, policy))
+	// two signers don't reach the default threshold of the roster
+	require.Error(t, protocol.BlsSignature(sig.Sig).Verify(testSuite, bft.Msg, publics))
+}
+
+func TestBftCoSiWeightsNotReached(t *testing.T) {
+	const protoName = "TestBftCoSiWeightsNotReached"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	// the four light nodes are not enough when the heavy ones are offline
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+	bft, _ := startProtocol(t, local, 6, 2, 0, protoName, func(bft *ByzCoinX) {
+		bft.Weights = []int{1, 1, 1, 1, 4, 4}
+		bft.Threshold = 8
+	})
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorThresholdNotReached), err)
+
+	// a non-negative weight is needed for every node and they must be able
+	// to reach the threshold
+	publics := bft.Roster().Publics()
+	for _, c := range []struct {
+		weights   []int
+		threshold int
+	}{
+		{[]int{1, 2}, 1},
+		{[]int{1, 1, 1, 1, 4, -1}, 1},
+		{[]int{1, 1, 1, 1, 2, 2}, 9},
+	} {
+		bft = &ByzCoinX{
+			CreateProtocol: func(string, *onet.Tree) (onet.ProtocolInstance, error) {
+				return nil, nil
+			},
+			FinalSignatureChan: make(chan FinalSignature, 1),
+			Weights:            c.weights,
+			Threshold:          c.threshold,
+			publics:            publics,
+			policyVerifier:     newBlsVerifier(newLRUCache(1), ""),
+		}
+		require.Error(t, bft.Start())
+	}
+}
+
+func TestBftCoSiRequireLeaderSignature(t *testing.T) {
+	const protoName = "TestBftCoSiRequireLeaderSignature"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verifyRefuse, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// the leader verifies first and refuses the proposal
+	bft, _ := startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+		bft.Threshold = 3
+		bft.RequireLeaderSignature = true
+	})
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorLeaderSignatureMissing), err)
+
+	// by default the refusal of the leader stops the round
+	bft, _ = startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+		bft.Threshold = 3
+	})
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorLeaderRefused), err)
+
+	// the other nodes are enough when the leader may refuse
+	bft, _ = startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+		bft.Threshold = 3
+		bft.AllowLeaderRefusal = true
+	})
+	err = getAndVerifySignature(bft.FinalSignatureChan, bft.ErrorChan, bft.Roster().Publics(), bft.Msg, 0)
+	require.NoError(t, err)
+}
+
+func TestBftCoSiIncludeData(t *testing.T) {
+	const protoName = "TestBftCoSiIncludeData"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	for _, include := range []bool{false, true} {
+		bft, _ := startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+			bft.IncludeData = include
+		})
+
+		sig := getSignature(t, bft)
+		require.NoError(t, protocol.BlsSignature(sig.Sig).Verify(testSuite, sig.Msg, bft.Roster().Publics()))
+
+		if !include {
+			require.Nil(t, sig.Data)
+			continue
+		}
+		require.Equal(t, bft.Data, sig.Data)
+		// the signature is enough to run the verification again
+		require.True(t, verify(sig.Msg, sig.Data))
+	}
+}
+
+func TestBftCoSiErrorThreshold(t *testing.T) {
+	const protoName = "TestBftCoSiErrorThreshold"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// a leaf is offline but every node is required
+	bft, _ := startProtocol(t, local, 4, 1, 0, protoName, func(bft *ByzCoinX) {
+		bft.Threshold = 4
+	})
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorThresholdNotReached), err)
+}
+
+func TestBftCoSiErrorTimeout(t *testing.T) {
+	const protoName = "TestBftCoSiErrorTimeout"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// every subleader candidate is offline so the root keeps regenerating
+	// the subtree until the timeout
+	bft, _ := startProtocol(t, local, 4, 3, 0, protoName, func(bft *ByzCoinX) {
+		bft.Threshold = 2
+		bft.SubleaderFailures = 1
+		bft.Timeout = 4 * time.Second
+	})
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorTimeout), err)
+}
+
+func TestBftCoSiErrorCancelled(t *testing.T) {
+	const protoName = "TestBftCoSiErrorCancelled"
+
+	var calls int32
+	block := make(chan struct{})
+	vf := func(msg, data []byte) bool {
+		// only the verification of the leader goes through
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-block
+		}
+		return true
+	}
+	err := GlobalInitBFTCoSiProtocol(testSuite, vf, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+	// let the followers finish before closing
+	defer close(block)
+
+	// the followers hang so the prepare phase never ends
+	var prepProto *protocol.BlsCosi
+	bft, _ := startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+		bft.CreateProtocol = func(name string, tree *onet.Tree) (onet.ProtocolInstance, error) {
+			pi, err := local.CreateProtocol(name, tree)
+			if name == protoName+"_cosi_prep" && err == nil {
+				prepProto = pi.(*protocol.BlsCosi)
+			}
+			return pi, err
+		}
+	})
+	require.NoError(t, bft.Shutdown())
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorCancelled), err)
+
+	// the cosi protocol is stopped without waiting for the followers
+	select {
+	case sig := <-prepProto.FinalSignature:
+		require.Nil(t, sig)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "the prepare phase is still running")
+	}
+}
+
+func TestBftCoSiErrorCommitStart(t *testing.T) {
+	const protoName = "TestBftCoSiErrorCommitStart"
+
+	err := GlobalInitBFTCoSiProtocol(testSuite, verify, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// the commit phase can't be created
+	bft, _ := startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+		bft.CreateProtocol = func(name string, tree *onet.Tree) (onet.ProtocolInstance, error) {
+			if name == protoName+"_cosi_commit" {
+				return nil, xerrors.New("commit unavailable")
+			}
+			return local.CreateProtocol(name, tree)
+		}
+	})
+	err = getError(t, bft)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "commit unavailable")
+}
+
+func TestBftCoSiVerifyCache(t *testing.T) {
+	const protoName = "TestBftCoSiVerifyCache"
+
+	var calls, acks int32
+	vf := func(msg, data []byte) bool {
+		atomic.AddInt32(&calls, 1)
+		return true
+	}
+	countAck := func(msg, data []byte) bool {
+		atomic.AddInt32(&acks, 1)
+		return true
+	}
+	err := GlobalInitBFTCoSiProtocol(testSuite, vf, countAck, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	// every node must sign so that every verification runs, and the
+	// function returns the number of verifications and acknowledgements of
+	// the round
+	propose := func(ttl time.Duration) (*ByzCoinX, int32, int32) {
+		bft, _ := startProtocol(t, local, 4, 0, 0, protoName, func(bft *ByzCoinX) {
+			bft.Msg = []byte("block")
+			bft.VerifyCacheTTL = ttl
+		})
+		require.Equal(t, 4, bft.Threshold)
+		err := getAndVerifySignature(bft.FinalSignatureChan, bft.ErrorChan,
+			bft.Roster().Publics(), bft.Msg, 0)
+		require.NoError(t, err)
+		return bft, atomic.SwapInt32(&calls, 0), atomic.SwapInt32(&acks, 0)
+	}
+
+	_, n, a := propose(time.Minute)
+	require.Equal(t, int32(4), n)
+	require.Equal(t, int32(4), a)
+	// only the leader skips its verification, the commit phase always runs
+	bft, n, a := propose(time.Minute)
+	require.Equal(t, int32(3), n)
+	require.Equal(t, int32(4), a)
+
+	bft.InvalidateVerifyCache()
+	_, n, _ = propose(time.Minute)
+	require.Equal(t, int32(4), n)
+
+	// without a TTL the verification runs every time
+	_, n, _ = propose(0)
+	require.Equal(t, int32(4), n)
+}
+
+func TestBftCoSiVerifyCacheRefusal(t *testing.T) {
+	const protoName = "TestBftCoSiVerifyCacheRefusal"
+
+	// the first verification fails and the next ones succeed
+	var calls int32
+	vf := func(msg, data []byte) bool {
+		return atomic.AddInt32(&calls, 1) > 1
+	}
+	err := GlobalInitBFTCoSiProtocol(testSuite, vf, ack, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	setup := func(bft *ByzCoinX) {
+		bft.Msg = []byte("block")
+		bft.VerifyCacheTTL = time.Minute
+	}
+
+	bft, _ := startProtocol(t, local, 1, 0, 0, protoName, setup)
+	require.Error(t, getError(t, bft))
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// the refusal is not cached so the retry is verified again
+	bft, _ = startProtocol(t, local, 1, 0, 0, protoName, setup)
+	err = getAndVerifySignature(bft.FinalSignatureChan, bft.ErrorChan,
+		bft.Roster().Publics(), bft.Msg, 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// and the acceptance is
+	bft, _ = startProtocol(t, local, 1, 0, 0, protoName, setup)
+	err = getAndVerifySignature(bft.FinalSignatureChan, bft.ErrorChan,
+		bft.Roster().Publics(), bft.Msg, 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestBftCoSiResume(t *testing.T) {
+	const protoName = "TestBftCoSiResume"
+
+	var calls int32
+	vf := func(msg, data []byte) bool {
+		atomic.AddInt32(&calls, 1)
+		return true
+	}
+	block := make(chan struct{})
+	blockingAck := func(msg, data []byte) bool {
+		<-block
+		return true
+	}
+	err := GlobalInitBFTCoSiProtocol(testSuite, vf, blockingAck, protoName)
+	require.NoError(t, err)
+
+	local := onet.NewLocalTest(testSuite)
+	defer local.CloseAll()
+
+	store := NewMemoryStore()
+	setup := func(bft *ByzCoinX) {
+		bft.Msg = []byte("block")
+		bft.Store = store
+	}
+
+	// the leader goes away during the commit phase
+	bft, _ := startProtocol(t, local, 4, 0, 0, protoName, setup)
+	key, err := bft.checkpointKey()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		buf, _ := store.Load(key)
+		return buf != nil
+	}, defaultTimeout, 10*time.Millisecond)
+	require.NoError(t, bft.Shutdown())
+	err = getError(t, bft)
+	require.True(t, xerrors.Is(err, ErrorCancelled), err)
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	buf0, err := store.Load(key)
+	require.NoError(t, err)
+	state := &RoundState{}
+	require.NoError(t, protobuf.Decode(buf0, state))
+	require.Equal(t, []byte("block"), state.Msg)
+	require.Equal(t, bft.Threshold, state.Threshold)
+	close(block)
+
+	// restart creates a fresh instance on the same roster
+	tree := bft.Tree()
+	threshold := bft.Threshold
+	restart := func(threshold int) *ByzCoinX {
+		pi, err := local.CreateProtocol(protoName, tree)
+		require.NoError(t, err)
+		bft := pi.(*ByzCoinX)
+		bft.CreateProtocol = local.CreateProtocol
+		bft.ErrorChan = make(chan error, 1)
+		bft.Data = []byte("hello world")
+		bft.Timeout = defaultTimeout
+		bft.Threshold = threshold
+		setup(bft)
+		return bft
+	}
+
+	// the configuration is checked before resuming, even when the
+	// checkpoint matches it
+	invalid := *state
+	invalid.Threshold = 5
+	buf, err := protobuf.Encode(&invalid)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(key, buf))
+	bft = restart(invalid.Threshold)
+	require.Error(t, bft.Start())
+
+	// which resumes from the commit phase
+	require.NoError(t, store.Save(key, buf0))
+	bft = restart(threshold)
+	require.NoError(t, bft.Start())
+	err = getAndVerifySignature(bft.FinalSignatureChan, bft.ErrorChan, bft.Roster().Publics(), bft.Msg, 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	buf, err = store.Load(key)
+	require.NoError(t, err)
+	require.Nil(t, buf)
+}
+
 func runProtocol(t *testing.T, nbrHosts int, nbrFault int, refuseIndex int, protoName string, scheme int) {
-	log.Lvlf1("Starting with %d hosts with %d faulty ones and refusing at %d. Protocol name is %s",
-		nbrHosts, nbrFault, refuseIndex, protoName)
+	runProtocolWithSetup(t, nbrHosts, nbrFault, refuseIndex, protoName, scheme, nil)
+}
+
+// runProtocolWithSetup runs the protocol like runProtocol but calls setup
+// on the root protocol instance right before it starts, if not nil.
+func runProtocolWithSetup(t *testing.T, nbrHosts int, nbrFault int, refuseIndex int, protoName string, scheme int,
+	setup func(*ByzCoinX)) {
 	local := onet.NewLocalTest(testSuite)
 	defer local.CloseAll()
 
+	bftCosiProto, counter := startProtocol(t, local, nbrHosts, nbrFault, refuseIndex, protoName, setup)
+
+	// verify signature
+	err := getAndVerifySignature(bftCosiProto.FinalSignatureChan, bftCosiProto.ErrorChan,
+		bftCosiProto.Roster().Publics(), bftCosiProto.Msg, scheme)
+	require.NoError(t, err)
+
+	// check the counters
+	counter.Lock()
+	defer counter.Unlock()
+
+	// We use <= because the verification function may be called more than
+	// once on the same node if a sub-leader in ftcosi fails and the tree is
+	// re-generated.
+	require.True(t, nbrHosts-nbrFault <= counter.veriCount)
+}
+
+// startProtocol creates the root protocol instance on a tree of nbrHosts
+// nodes, pauses the last nbrFault servers, calls setup if not nil and
+// starts the protocol.
+func startProtocol(t *testing.T, local *onet.LocalTest, nbrHosts int, nbrFault int, refuseIndex int, protoName string,
+	setup func(*ByzCoinX)) (*ByzCoinX, *Counter) {
+	log.Lvlf1("Starting with %d hosts with %d faulty ones and refusing at %d. Protocol name is %s",
+		nbrHosts, nbrFault, refuseIndex, protoName)
+
 	servers, roster, tree := local.GenTree(nbrHosts, false)
 	require.NotNil(t, roster)
 
 	pi, err := local.CreateProtocol(protoName, tree)
 	require.NoError(t, err)
 
-	publics := roster.Publics()
 	bftCosiProto := pi.(*ByzCoinX)
 	bftCosiProto.CreateProtocol = local.CreateProtocol
 	bftCosiProto.FinalSignatureChan = make(chan FinalSignature, 1)
+	bftCosiProto.ErrorChan = make(chan error, 1)
 
 	counter := &Counter{refuseIndex: refuseIndex}
 	counters.add(counter)
@@ -209,28 +729,51 @@ func runProtocol(t *testing.T, nbrHosts int, nbrFault int, refuseIndex int, prot
 		servers[i].Pause()
 	}
 
+	if setup != nil {
+		setup(bftCosiProto)
+	}
+
 	err = bftCosiProto.Start()
 	require.NoError(t, err)
 
-	// verify signature
-	err = getAndVerifySignature(bftCosiProto.FinalSignatureChan, publics, proposal, scheme)
-	require.NoError(t, err)
+	return bftCosiProto, counter
+}
 
-	// check the counters
-	counter.Lock()
-	defer counter.Unlock()
+// getError waits for the protocol to report a failure.
+func getError(t *testing.T, bft *ByzCoinX) error {
+	select {
+	case err := <-bft.ErrorChan:
+		// only one of the channels is written
+		require.Len(t, bft.FinalSignatureChan, 0)
+		return err
+	case <-bft.FinalSignatureChan:
+		require.Fail(t, "got a signature instead of an error")
+	case <-time.After(defaultTimeout + time.Second):
+		require.Fail(t, "didn't get an error before the timeout")
+	}
+	return nil
+}
 
-	// We use <= because the verification function may be called more than
-	// once on the same node if a sub-leader in ftcosi fails and the tree is
-	// re-generated.
-	require.True(t, nbrHosts-nbrFault <= counter.veriCount)
+func getSignature(t *testing.T, bft *ByzCoinX) FinalSignature {
+	select {
+	case sig := <-bft.FinalSignatureChan:
+		return sig
+	case err := <-bft.ErrorChan:
+		require.NoError(t, err)
+	case <-time.After(defaultTimeout + time.Second):
+		require.Fail(t, "didn't get a signature before the timeout")
+	}
+	return FinalSignature{}
 }
 
-func getAndVerifySignature(sigChan chan FinalSignature, publics []kyber.Point, proposal []byte, scheme int) error {
+func getAndVerifySignature(sigChan chan FinalSignature, errChan chan error, publics []kyber.Point,
+	proposal []byte, scheme int) error {
 	var sig FinalSignature
 	timeout := defaultTimeout + time.Second
 	select {
 	case sig = <-sigChan:
+	case err := <-errChan:
+		return fmt.Errorf("protocol failed: %v", err)
 	case <-time.After(timeout):
 		return fmt.Errorf("didn't get commitment after a timeout of %v", timeout)
 	}
@@ -263,3 +806,17 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+// BenchmarkVerifyFinalSignature measures the verification of a final
+// signature for both schemes as the roster grows.
+func BenchmarkVerifyFinalSignature(b *testing.B) {
+	for _, n := range []int{4, 16, 64, 256} {
+		runSchemes(b, n, strconv.Itoa(n), func(b *testing.B, bc benchCase) {
+			for i := 0; i < b.N; i++ {
+				if err := bc.verify(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
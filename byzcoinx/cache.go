@@ -0,0 +1,241 @@
+package byzcoinx
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
+	"go.dedis.ch/cothority/v3/blscosi/protocol"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/kyber/v3/sign"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+)
+
+// aggregateKeyCacheSize is the maximum number of aggregate public keys kept
+// in memory for each registered protocol.
+const aggregateKeyCacheSize = 128
+
+// lruCache is a bounded key-value store that evicts the least recently used
+// entry when it is full. It is safe for concurrent use.
+type lruCache struct {
+	sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value stored for the key and marks it as recently used.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// put stores the value for the key and evicts the oldest entry if the cache
+// grows above its size.
+func (c *lruCache) put(key string, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// remove deletes the entry of the key if it exists.
+func (c *lruCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// len returns the number of entries in the cache.
+func (c *lruCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// policyVerifierFn verifies a final signature like a VerifierFn but checks
+// the signers against the given policy.
+type policyVerifierFn func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point, policy sign.Policy) error
+
+// withDefaultPolicy returns a verifier that requires the default threshold
+// of signers.
+func (v policyVerifierFn) withDefaultPolicy() VerifierFn {
+	return func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point) error {
+		policy := sign.NewThresholdPolicy(protocol.DefaultThreshold(len(pubkeys)))
+		return v(suite, msg, sig, pubkeys, policy)
+	}
+}
+
+// rosterKey returns a hash of the public keys, in order, that identifies the
+// roster in the cache keys. The roster ID is not used because it is not
+// recomputed when a roster is received, so it doesn't guarantee the keys.
+func rosterKey(publics []kyber.Point) (string, error) {
+	h := sha256.New()
+	for _, p := range publics {
+		if _, err := p.MarshalTo(h); err != nil {
+			return "", err
+		}
+	}
+	return string(h.Sum(nil)), nil
+}
+
+// cachedAggregateKey returns an aggregate function that looks up the
+// aggregate public key in the cache before computing it. The roster key is
+// the hash of the public keys of the roster, given by rosterKey, so the pair
+// (roster key, mask) uniquely identifies the set of signers. The returned
+// function must only be used with the public keys of that roster.
+func cachedAggregateKey(cache *lruCache, rk string, aggregate protocol.AggregateKeyFn) protocol.AggregateKeyFn {
+	return func(suite pairing.Suite, mask *sign.Mask) (kyber.Point, error) {
+		key := rk + string(mask.Mask())
+		if v, ok := cache.get(key); ok {
+			return v.(kyber.Point), nil
+		}
+
+		aggPub, err := aggregate(suite, mask)
+		if err != nil {
+			return nil, err
+		}
+		cache.put(key, aggPub)
+		return aggPub, nil
+	}
+}
+
+// newBlsVerifier returns a verifier for BLS signatures of the given roster
+// that caches the aggregate public keys.
+func newBlsVerifier(cache *lruCache, rk string) policyVerifierFn {
+	aggregate := cachedAggregateKey(cache, rk, protocol.AggregatePublicKeys)
+	return func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point, policy sign.Policy) error {
+		return protocol.BlsSignature(sig).VerifyWithAggregateKey(suite, msg, pubkeys, policy, aggregate)
+	}
+}
+
+// newBdnVerifier returns a verifier for BDN signatures of the given roster
+// that caches the aggregate public keys.
+func newBdnVerifier(cache *lruCache, rk string) policyVerifierFn {
+	aggregate := cachedAggregateKey(cache, rk, bdn.AggregatePublicKeys)
+	return func(suite pairing.Suite, msg, sig []byte, pubkeys []kyber.Point, policy sign.Policy) error {
+		return bdnproto.BdnSignature(sig).VerifyWithAggregateKey(suite, msg, pubkeys, policy, aggregate)
+	}
+}
+
+// verdictCacheSize is the maximum number of proposals whose verdicts are
+// kept in memory for each registered protocol.
+const verdictCacheSize = 64
+
+// verdictCache remembers the proposals accepted by the verification
+// function run by the leader in the prepare phase so that a proposal
+// submitted again is not verified a second time. The acknowledgement of the
+// commit phase may have side effects and always runs. Only proposals enabled by the leader are cached
+// and a refusal is never remembered, so that a proposal refused because of
+// a transient failure can be accepted later.
+type verdictCache struct {
+	*lruCache
+}
+
+// verdict is the cached acceptance of a proposal. It holds until the
+// expiry.
+type verdict struct {
+	sync.Mutex
+	ttl    time.Duration
+	expiry time.Time
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{newLRUCache(verdictCacheSize)}
+}
+
+func verdictKey(msg, data []byte) string {
+	h := sha256.New()
+	h.Write(msg)
+	h.Write(data)
+	return string(h.Sum(nil))
+}
+
+// enable makes the verdict of the proposal cacheable for the given
+// duration.
+func (c *verdictCache) enable(msg, data []byte, ttl time.Duration) {
+	key := verdictKey(msg, data)
+	if v, ok := c.get(key); ok {
+		v.(*verdict).Lock()
+		v.(*verdict).ttl = ttl
+		v.(*verdict).Unlock()
+	} else {
+		c.put(key, &verdict{ttl: ttl})
+	}
+}
+
+// disable drops the verdict of the proposal so that it is verified every
+// time.
+func (c *verdictCache) disable(msg, data []byte) {
+	c.remove(verdictKey(msg, data))
+}
+
+// invalidate drops every cached verdict.
+func (c *verdictCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// wrap returns a verification function that accepts the proposal without
+// running the verification when it has a fresh cached acceptance.
+func (c *verdictCache) wrap(vf protocol.VerificationFn) protocol.VerificationFn {
+	return func(msg, data []byte) bool {
+		v, ok := c.get(verdictKey(msg, data))
+		if !ok {
+			return vf(msg, data)
+		}
+
+		entry := v.(*verdict)
+		entry.Lock()
+		defer entry.Unlock()
+		if time.Now().Before(entry.expiry) {
+			return true
+		}
+		if !vf(msg, data) {
+			entry.expiry = time.Time{}
+			return false
+		}
+		entry.expiry = time.Now().Add(entry.ttl)
+		return true
+	}
+}
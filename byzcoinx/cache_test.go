@@ -0,0 +1,198 @@
+package byzcoinx
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
+	"go.dedis.ch/cothority/v3/blscosi/protocol"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+	"go.dedis.ch/kyber/v3/sign/bls"
+	"go.dedis.ch/kyber/v3/util/random"
+)
+
+// makeSignature creates the keys of n signers and returns their aggregated
+// signature over msg with the participation mask appended, as produced at
+// the end of a byzcoinx round. Scheme 1 is BDN, any other value is BLS.
+func makeSignature(t testing.TB, scheme, n int, msg []byte) ([]byte, []kyber.Point) {
+	secrets := make([]kyber.Scalar, n)
+	publics := make([]kyber.Point, n)
+	for i := range secrets {
+		if scheme == 1 {
+			secrets[i], publics[i] = bdn.NewKeyPair(testSuite, random.New())
+		} else {
+			secrets[i], publics[i] = bls.NewKeyPair(testSuite, random.New())
+		}
+	}
+
+	mask, err := sign.NewMask(testSuite, publics, nil)
+	require.NoError(t, err)
+	sigs := make([][]byte, n)
+	for i, secret := range secrets {
+		require.NoError(t, mask.SetBit(i, true))
+		if scheme == 1 {
+			sigs[i], err = bdn.Sign(testSuite, secret, msg)
+		} else {
+			sigs[i], err = bls.Sign(testSuite, secret, msg)
+		}
+		require.NoError(t, err)
+	}
+
+	var sig []byte
+	if scheme == 1 {
+		agg, err := bdn.AggregateSignatures(testSuite, sigs, mask)
+		require.NoError(t, err)
+		sig, err = agg.MarshalBinary()
+		require.NoError(t, err)
+	} else {
+		sig, err = bls.AggregateSignatures(testSuite, sigs...)
+		require.NoError(t, err)
+	}
+
+	return append(sig, mask.Mask()...), publics
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.put("a", 1)
+	c.put("b", 2)
+
+	// touch a so that b becomes the oldest entry
+	v, ok := c.get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	c.put("c", 3)
+	require.Equal(t, 2, c.len())
+	_, ok = c.get("b")
+	require.False(t, ok)
+	_, ok = c.get("a")
+	require.True(t, ok)
+	_, ok = c.get("c")
+	require.True(t, ok)
+
+	c.remove("a")
+	require.Equal(t, 1, c.len())
+	_, ok = c.get("a")
+	require.False(t, ok)
+}
+
+func TestCachedVerifier(t *testing.T) {
+	msg := []byte("abc")
+
+	for _, scheme := range []int{0, 1} {
+		sig, publics := makeSignature(t, scheme, 4, msg)
+		rk, err := rosterKey(publics)
+		require.NoError(t, err)
+
+		cache := newLRUCache(aggregateKeyCacheSize)
+		verifier := newBlsVerifier(cache, rk).withDefaultPolicy()
+		if scheme == 1 {
+			verifier = newBdnVerifier(cache, rk).withDefaultPolicy()
+		}
+
+		require.NoError(t, verifier(testSuite, msg, sig, publics))
+		require.Equal(t, 1, cache.len())
+		// second verification uses the cached aggregate
+		require.NoError(t, verifier(testSuite, msg, sig, publics))
+		require.Equal(t, 1, cache.len())
+
+		require.Error(t, verifier(testSuite, []byte("abd"), sig, publics))
+		require.Error(t, verifier(testSuite, msg, sig[:4], publics))
+		require.Error(t, verifier(testSuite, msg, sig, nil))
+	}
+}
+
+func TestCachedVerifierRosters(t *testing.T) {
+	msg := []byte("abc")
+	sig1, publics1 := makeSignature(t, 0, 4, msg)
+	sig2, publics2 := makeSignature(t, 0, 4, msg)
+	rk1, err := rosterKey(publics1)
+	require.NoError(t, err)
+	rk2, err := rosterKey(publics2)
+	require.NoError(t, err)
+	require.NotEqual(t, rk1, rk2)
+
+	// the rosters share the cache and sign with the same mask but their
+	// aggregate keys must not be mixed up
+	cache := newLRUCache(aggregateKeyCacheSize)
+	verifier1 := newBlsVerifier(cache, rk1).withDefaultPolicy()
+	verifier2 := newBlsVerifier(cache, rk2).withDefaultPolicy()
+	require.NoError(t, verifier1(testSuite, msg, sig1, publics1))
+	require.NoError(t, verifier2(testSuite, msg, sig2, publics2))
+	require.Equal(t, 2, cache.len())
+	require.Error(t, verifier2(testSuite, msg, sig1, publics2))
+}
+
+// benchCase is a signature of one of the schemes with the keys of its
+// signers.
+type benchCase struct {
+	scheme  int
+	msg     []byte
+	sig     []byte
+	publics []kyber.Point
+	rk      string
+}
+
+// verifier returns the verifier that byzcoinx builds for the scheme.
+func (bc benchCase) verifier(cache *lruCache) VerifierFn {
+	if bc.scheme == 1 {
+		return newBdnVerifier(cache, bc.rk).withDefaultPolicy()
+	}
+	return newBlsVerifier(cache, bc.rk).withDefaultPolicy()
+}
+
+// verify verifies the signature with the Verify of its scheme.
+func (bc benchCase) verify() error {
+	if bc.scheme == 1 {
+		return bdnproto.BdnSignature(bc.sig).Verify(testSuite, bc.msg, bc.publics)
+	}
+	return protocol.BlsSignature(bc.sig).Verify(testSuite, bc.msg, bc.publics)
+}
+
+// runSchemes runs f as a sub-benchmark named after the scheme and the
+// suffix for each scheme, with a signature of n signers.
+func runSchemes(b *testing.B, n int, suffix string, f func(b *testing.B, bc benchCase)) {
+	for _, scheme := range []int{0, 1} {
+		name := "BLS"
+		if scheme == 1 {
+			name = "BDN"
+		}
+
+		bc := benchCase{scheme: scheme, msg: []byte("abc")}
+		bc.sig, bc.publics = makeSignature(b, scheme, n, bc.msg)
+		var err error
+		bc.rk, err = rosterKey(bc.publics)
+		require.NoError(b, err)
+
+		b.Run(fmt.Sprintf("%s/%s", name, suffix), func(b *testing.B) {
+			f(b, bc)
+		})
+	}
+}
+
+// BenchmarkVerifyAggregateCache compares the verification of 1000 rounds
+// signed by the same roster with and without the aggregate key cache.
+func BenchmarkVerifyAggregateCache(b *testing.B) {
+	const rounds = 1000
+
+	runSchemes(b, 64, "uncached", func(b *testing.B, bc benchCase) {
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < rounds; j++ {
+				require.NoError(b, bc.verify())
+			}
+		}
+	})
+
+	runSchemes(b, 64, "cached", func(b *testing.B, bc benchCase) {
+		for i := 0; i < b.N; i++ {
+			verifier := bc.verifier(newLRUCache(aggregateKeyCacheSize))
+			for j := 0; j < rounds; j++ {
+				require.NoError(b, verifier(testSuite, bc.msg, bc.sig, bc.publics))
+			}
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package byzcoinx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+)
+
+// ProtocolStore persists the checkpoints of the rounds run by a leader so
+// that a round can be resumed after the leader restarts.
+type ProtocolStore interface {
+	// Save stores the checkpoint under the key, replacing any previous one.
+	Save(key string, data []byte) error
+	// Load returns the checkpoint of the key, or nil if there is none.
+	Load(key string) ([]byte, error)
+	// Delete removes the checkpoint of the key if it exists.
+	Delete(key string) error
+}
+
+// RoundState is the checkpoint of a round once the prepare phase is done.
+// The prepare signature holds the aggregate and the mask of the signers.
+// The aggregation in progress, i.e. the mask and the responses collected so
+// far, is not checkpointed: a round interrupted during a phase runs that
+// phase again from the start.
+type RoundState struct {
+	Msg        []byte
+	Data       []byte
+	Threshold  int
+	PrepareSig []byte
+}
+
+// MemoryStore is a ProtocolStore keeping the checkpoints in memory.
+type MemoryStore struct {
+	sync.Mutex
+	states map[string][]byte
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string][]byte)}
+}
+
+// Save implements ProtocolStore.
+func (s *MemoryStore) Save(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.states[key] = append([]byte{}, data...)
+	return nil
+}
+
+// Load implements ProtocolStore.
+func (s *MemoryStore) Load(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.states[key], nil
+}
+
+// Delete implements ProtocolStore.
+func (s *MemoryStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+// checkpointKey identifies the round by its protocol, the public keys of
+// its roster, its message and its data.
+func (bft *ByzCoinX) checkpointKey() (string, error) {
+	rk, err := rosterKey(bft.publics)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(bft.prepCosiProtoName))
+	h.Write([]byte(rk))
+	h.Write(bft.Msg)
+	h.Write(bft.Data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadCheckpoint returns the checkpoint of the round if the store has one
+// matching the proposal, nil otherwise.
+func (bft *ByzCoinX) loadCheckpoint() *RoundState {
+	if bft.Store == nil {
+		return nil
+	}
+	key, err := bft.checkpointKey()
+	if err != nil {
+		log.Warn("couldn't compute the key of the checkpoint:", err)
+		return nil
+	}
+	buf, err := bft.Store.Load(key)
+	if err != nil {
+		log.Warn("couldn't load the checkpoint of the round:", err)
+		return nil
+	}
+	if buf == nil {
+		return nil
+	}
+
+	state := &RoundState{}
+	if err := protobuf.Decode(buf, state); err != nil {
+		log.Warn("couldn't decode the checkpoint of the round:", err)
+		return nil
+	}
+	if !bytes.Equal(state.Msg, bft.Msg) || !bytes.Equal(state.Data, bft.Data) {
+		log.Lvl2("Ignoring the checkpoint of a different proposal")
+		return nil
+	}
+	if state.Threshold != bft.Threshold {
+		log.Lvl2("Ignoring the checkpoint of a round with a different threshold")
+		return nil
+	}
+	return state
+}
+
+// saveCheckpoint stores the signature of the prepare phase so that the round
+// can resume from the commit phase. Failing to do so doesn't stop the round.
+func (bft *ByzCoinX) saveCheckpoint(prepSig []byte) {
+	if bft.Store == nil {
+		return
+	}
+	key, err := bft.checkpointKey()
+	if err == nil {
+		var buf []byte
+		buf, err = protobuf.Encode(&RoundState{
+			Msg:        bft.Msg,
+			Data:       bft.Data,
+			Threshold:  bft.Threshold,
+			PrepareSig: prepSig,
+		})
+		if err == nil {
+			err = bft.Store.Save(key, buf)
+		}
+	}
+	if err != nil {
+		log.Warn("couldn't save the checkpoint of the round:", err)
+	}
+}
+
+// clearCheckpoint removes the checkpoint once the round is over.
+func (bft *ByzCoinX) clearCheckpoint() {
+	if bft.Store == nil {
+		return
+	}
+	key, err := bft.checkpointKey()
+	if err == nil {
+		err = bft.Store.Delete(key)
+	}
+	if err != nil {
+		log.Warn("couldn't delete the checkpoint of the round:", err)
+	}
+}
@@ -224,12 +224,14 @@ export class ByzcoinSignature extends Message<ByzcoinSignature> {
 
     readonly msg: Buffer;
     readonly sig: Buffer;
+    readonly data: Buffer;
 
     constructor(props?: Properties<ByzcoinSignature>) {
         super(props);
 
         this.msg = Buffer.from(this.msg || EMPTY_BUFFER);
         this.sig = Buffer.from(this.sig || EMPTY_BUFFER);
+        this.data = Buffer.from(this.data || EMPTY_BUFFER);
     }
 
     /**
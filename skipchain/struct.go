@@ -753,8 +753,9 @@ func (fl *ForwardLink) Copy() *ForwardLink {
 	}
 	return &ForwardLink{
 		Signature: byzcoinx.FinalSignature{
-			Sig: append([]byte{}, fl.Signature.Sig...),
-			Msg: append([]byte{}, fl.Signature.Msg...),
+			Sig:  append([]byte{}, fl.Signature.Sig...),
+			Msg:  append([]byte{}, fl.Signature.Msg...),
+			Data: append([]byte(nil), fl.Signature.Data...),
 		},
 		From:      append([]byte{}, fl.From...),
 		To:        append([]byte{}, fl.To...),